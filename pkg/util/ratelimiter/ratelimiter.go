@@ -0,0 +1,232 @@
+/*
+ * Copyright (c) 2017, MegaEase
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package ratelimiter provides a cycle based rate limiter: every
+// Policy.LimitRefreshPeriod the limiter is refilled with
+// Policy.LimitForPeriod permissions, and callers ask for one or more
+// permissions via AcquirePermission(N) or WaitPermission(N).
+package ratelimiter
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+// nowFunc is overridden in tests so the limiter's notion of time can be
+// driven deterministically.
+var nowFunc = time.Now
+
+// Policy describes one rate limiting window: LimitForPeriod permissions are
+// handed out every LimitRefreshPeriod, and a caller is willing to wait up
+// to TimeoutDuration for the next one to become available. Burst caps how
+// many permissions can be stored up for a single request to consume in one
+// go (e.g. a large request metered in bytes); when left zero it defaults
+// to LimitForPeriod, i.e. no burst beyond one period's worth of refill.
+// SoftLimitRatio, when set (0, 1], asks AcquirePermission(N) to report
+// StateNearLimit once remaining permits drop below (1-SoftLimitRatio) of
+// Burst, so a caller can warn before it actually starts rejecting; zero
+// disables the soft-limit notification for this Policy.
+type Policy struct {
+	LimitRefreshPeriod time.Duration
+	LimitForPeriod     int
+	TimeoutDuration    time.Duration
+	Burst              int
+	SoftLimitRatio     float64
+}
+
+// LimitState reports how close to its limit a RateLimiter is for the
+// request that was just (dis)admitted.
+type LimitState int
+
+const (
+	// StateOK means the request was admitted with room to spare.
+	StateOK LimitState = iota
+	// StateNearLimit means the request was admitted, but at least one
+	// stage has crossed its Policy.SoftLimitRatio.
+	StateNearLimit
+	// StateRejected means the request was not admitted.
+	StateRejected
+)
+
+func (p *Policy) burst() int64 {
+	if p.Burst > 0 {
+		return int64(p.Burst)
+	}
+	return int64(p.LimitForPeriod)
+}
+
+// PolicyMulti composes several Policy windows into a single limiter, e.g.
+// 100 req/s stacked with 1000 req/min and 5000 req/hour. A request is only
+// admitted when every stage admits it.
+type PolicyMulti struct {
+	Stages []Policy
+}
+
+// stage tracks the refill cycle for a single Policy within a RateLimiter.
+type stage struct {
+	policy  Policy
+	cycle   int64
+	permits int64
+}
+
+// refresh advances the stage to the cycle currentNanos falls into,
+// refilling up to policy.LimitForPeriod permits for every cycle that has
+// elapsed since the stage was last touched.
+func (s *stage) refresh(currentNanos int64) {
+	cyclePeriod := s.policy.LimitRefreshPeriod.Nanoseconds()
+	currentCycle := currentNanos / cyclePeriod
+	if currentCycle == s.cycle {
+		return
+	}
+
+	elapsedCycles := currentCycle - s.cycle
+	accumulated := elapsedCycles*int64(s.policy.LimitForPeriod) + s.permits
+	if burst := s.policy.burst(); accumulated > burst {
+		accumulated = burst
+	}
+	s.permits = accumulated
+	s.cycle = currentCycle
+}
+
+// nanosToWait returns how long, from currentNanos, a caller must wait for
+// this stage to admit a request of n permits. It must be called after
+// refresh.
+func (s *stage) nanosToWait(currentNanos, n int64) int64 {
+	if s.permits >= n {
+		return 0
+	}
+
+	cyclePeriod := s.policy.LimitRefreshPeriod.Nanoseconds()
+	limitForPeriod := int64(s.policy.LimitForPeriod)
+	nanosToNextCycle := (s.cycle+1)*cyclePeriod - currentNanos
+
+	// after waiting out the current cycle we get one more refill; debt is
+	// whatever is still missing beyond that.
+	debt := n - s.permits - limitForPeriod
+	var extraCycles int64
+	if debt > 0 {
+		extraCycles = (debt + limitForPeriod - 1) / limitForPeriod // ceil
+	}
+
+	return extraCycles*cyclePeriod + nanosToNextCycle
+}
+
+// RateLimiter admits requests according to one or more stacked Policy
+// windows. The zero value is not usable; create one with New or NewMulti.
+type RateLimiter struct {
+	mutex  sync.Mutex
+	start  time.Time
+	stages []*stage
+}
+
+// New creates a RateLimiter following a single Policy.
+func New(policy *Policy) *RateLimiter {
+	return newRateLimiter([]Policy{*policy})
+}
+
+// NewMulti creates a RateLimiter whose stages must all admit a request for
+// it to be permitted, see PolicyMulti.
+func NewMulti(policy *PolicyMulti) *RateLimiter {
+	return newRateLimiter(policy.Stages)
+}
+
+func newRateLimiter(policies []Policy) *RateLimiter {
+	stages := make([]*stage, len(policies))
+	for i, p := range policies {
+		stages[i] = &stage{policy: p, permits: p.burst()}
+	}
+
+	return &RateLimiter{
+		start:  nowFunc(),
+		stages: stages,
+	}
+}
+
+// AcquirePermission tries to reserve a single permission from every stage
+// immediately, see AcquirePermissionN.
+func (l *RateLimiter) AcquirePermission() (bool, time.Duration, LimitState) {
+	return l.AcquirePermissionN(1)
+}
+
+// AcquirePermissionN tries to reserve n permissions from every stage
+// immediately. It reports whether the request is permitted, how long the
+// caller would need to wait for the reserved slot, and the resulting
+// LimitState. The wait is the maximum of the waits required across
+// stages; if that maximum exceeds any single stage's TimeoutDuration the
+// request is rejected without consuming a permission from any stage, and
+// the returned duration is that stage's TimeoutDuration instead of the
+// actual wait. n that doesn't fit in an int64 (e.g. derived from
+// attacker-controlled input) is rejected outright rather than wrapping
+// into the stage bookkeeping.
+func (l *RateLimiter) AcquirePermissionN(n uint64) (bool, time.Duration, LimitState) {
+	if n > math.MaxInt64 {
+		return false, 0, StateRejected
+	}
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	currentNanos := nowFunc().Sub(l.start).Nanoseconds()
+	permits := int64(n)
+
+	var maxWait int64
+	for _, s := range l.stages {
+		s.refresh(currentNanos)
+		if w := s.nanosToWait(currentNanos, permits); w > maxWait {
+			maxWait = w
+		}
+	}
+
+	for _, s := range l.stages {
+		if maxWait > s.policy.TimeoutDuration.Nanoseconds() {
+			return false, s.policy.TimeoutDuration, StateRejected
+		}
+	}
+
+	state := StateOK
+	for _, s := range l.stages {
+		s.permits -= permits
+		if s.policy.SoftLimitRatio > 0 {
+			burst := s.policy.burst()
+			softLimitThreshold := burst - int64(float64(burst)*s.policy.SoftLimitRatio)
+			if s.permits < softLimitThreshold {
+				state = StateNearLimit
+			}
+		}
+	}
+
+	return true, time.Duration(maxWait), state
+}
+
+// WaitPermission behaves like AcquirePermission but blocks the caller for
+// the wait it reports, returning whether permission was ultimately
+// granted.
+func (l *RateLimiter) WaitPermission() bool {
+	return l.WaitPermissionN(1)
+}
+
+// WaitPermissionN behaves like AcquirePermissionN but blocks the caller
+// for the wait it reports, returning whether permission was ultimately
+// granted.
+func (l *RateLimiter) WaitPermissionN(n uint64) bool {
+	permitted, wait, _ := l.AcquirePermissionN(n)
+	if wait > 0 {
+		time.Sleep(wait)
+	}
+	return permitted
+}
@@ -0,0 +1,96 @@
+/*
+ * Copyright (c) 2017, MegaEase
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ratelimiter
+
+import (
+	"testing"
+	"time"
+)
+
+func TestMultiStageSlackSecondSaturatedMinute(t *testing.T) {
+	setup()
+
+	policy := PolicyMulti{
+		Stages: []Policy{
+			{ // 100 req/s, plenty of slack for this test
+				LimitRefreshPeriod: time.Second,
+				LimitForPeriod:     100,
+				TimeoutDuration:    time.Millisecond * 50,
+			},
+			{ // 3 req/min, saturated quickly
+				LimitRefreshPeriod: time.Minute,
+				LimitForPeriod:     3,
+				TimeoutDuration:    time.Millisecond * 50,
+			},
+		},
+	}
+
+	limiter := NewMulti(&policy)
+
+	for i := 0; i < 3; i++ {
+		if permitted, _, _ := limiter.AcquirePermission(); !permitted {
+			t.Errorf("AcquirePermission should succeed: %d", i)
+		}
+	}
+
+	// the per-minute stage is now saturated even though the per-second
+	// stage still has plenty of headroom.
+	if permitted, d, _ := limiter.AcquirePermission(); permitted {
+		t.Errorf("AcquirePermission should fail once the per-minute stage is saturated")
+	} else if d != policy.Stages[1].TimeoutDuration {
+		t.Errorf("wait duration should be the stages' shared 50ms timeout, got: %s", d.String())
+	}
+}
+
+func TestMultiStageRejectionDoesNotConsumeTokens(t *testing.T) {
+	setup()
+
+	policy := PolicyMulti{
+		Stages: []Policy{
+			{ // plenty of slack, its timeout is never the limiting factor here
+				LimitRefreshPeriod: time.Millisecond * 10,
+				LimitForPeriod:     5,
+				TimeoutDuration:    time.Hour,
+			},
+			{ // saturates after one request and has no timeout budget
+				LimitRefreshPeriod: time.Minute,
+				LimitForPeriod:     1,
+				TimeoutDuration:    0,
+			},
+		},
+	}
+
+	limiter := NewMulti(&policy)
+
+	if permitted, _, _ := limiter.AcquirePermission(); !permitted {
+		t.Errorf("first AcquirePermission should succeed")
+	}
+
+	// the slow stage is exhausted and has no timeout budget, so this must
+	// be rejected without touching its single token.
+	if permitted, _, _ := limiter.AcquirePermission(); permitted {
+		t.Errorf("AcquirePermission should fail while the slow stage is saturated")
+	}
+
+	now = now.Add(time.Minute)
+
+	if permitted, _, _ := limiter.AcquirePermission(); !permitted {
+		t.Errorf("AcquirePermission should succeed once the slow stage refreshed, " +
+			"which would be impossible if the rejected call had consumed its only token")
+	}
+}
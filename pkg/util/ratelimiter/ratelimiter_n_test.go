@@ -0,0 +1,89 @@
+/*
+ * Copyright (c) 2017, MegaEase
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ratelimiter
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+func TestAcquirePermissionN(t *testing.T) {
+	setup()
+
+	policy := Policy{
+		LimitRefreshPeriod: time.Millisecond * 10,
+		TimeoutDuration:    time.Millisecond * 50,
+		LimitForPeriod:     5,
+	}
+	limiter := New(&policy)
+
+	if permitted, d, _ := limiter.AcquirePermissionN(3); !permitted {
+		t.Errorf("AcquirePermissionN(3) should succeed")
+	} else if d != 0 {
+		t.Errorf("wait duration should be zero, got: %s", d.String())
+	}
+
+	// only 2 permits left in this cycle, so the next 3-token request
+	// must wait for the following refresh.
+	if permitted, d, _ := limiter.AcquirePermissionN(3); !permitted {
+		t.Errorf("AcquirePermissionN(3) should succeed after waiting for a refresh")
+	} else if d != policy.LimitRefreshPeriod {
+		t.Errorf("wait duration should be one refresh period, got: %s", d.String())
+	}
+
+	// a burst far larger than can ever be granted within TimeoutDuration
+	// must be rejected outright, and must not consume any permits.
+	if permitted, d, _ := limiter.AcquirePermissionN(1000); permitted {
+		t.Errorf("AcquirePermissionN(1000) should fail")
+	} else if d != policy.TimeoutDuration {
+		t.Errorf("wait duration should be the policy timeout, got: %s", d.String())
+	}
+
+	// had the rejected call consumed its 1000 permits, this single permit
+	// would be hundreds of refresh periods away and be rejected too.
+	if permitted, _, _ := limiter.AcquirePermissionN(1); !permitted {
+		t.Errorf("AcquirePermissionN(1) should still succeed, the rejected attempt above must not have consumed permits")
+	}
+}
+
+func TestAcquirePermissionNRejectsOverflow(t *testing.T) {
+	setup()
+
+	policy := Policy{
+		LimitRefreshPeriod: time.Millisecond * 10,
+		TimeoutDuration:    time.Millisecond * 50,
+		LimitForPeriod:     5,
+	}
+	limiter := New(&policy)
+
+	// n beyond int64's range must not be allowed to wrap into a negative
+	// permit count and be admitted for free.
+	if permitted, d, state := limiter.AcquirePermissionN(math.MaxInt64 + 1); permitted {
+		t.Errorf("AcquirePermissionN(MaxInt64+1) should fail")
+	} else if d != 0 {
+		t.Errorf("wait duration should be zero, got: %s", d.String())
+	} else if state != StateRejected {
+		t.Errorf("state should be StateRejected, got: %v", state)
+	}
+
+	// the rejected call above must not have corrupted the stage's permits.
+	if permitted, _, _ := limiter.AcquirePermissionN(5); !permitted {
+		t.Errorf("AcquirePermissionN(5) should still succeed after the overflowing call was rejected")
+	}
+}
@@ -0,0 +1,68 @@
+/*
+ * Copyright (c) 2017, MegaEase
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ratelimiter
+
+import (
+	"testing"
+	"time"
+)
+
+func TestAcquirePermissionSoftLimit(t *testing.T) {
+	setup()
+
+	policy := Policy{
+		LimitRefreshPeriod: time.Millisecond * 10,
+		TimeoutDuration:    time.Millisecond * 50,
+		LimitForPeriod:     10,
+		SoftLimitRatio:     0.2, // warn once remaining permits drop below 8
+	}
+	limiter := New(&policy)
+
+	for i := 0; i < 2; i++ {
+		if permitted, _, state := limiter.AcquirePermission(); !permitted {
+			t.Errorf("AcquirePermission should succeed: %d", i)
+		} else if state != StateOK {
+			t.Errorf("state should still be StateOK at %d, got: %v", i, state)
+		}
+	}
+
+	if permitted, _, state := limiter.AcquirePermission(); !permitted {
+		t.Errorf("AcquirePermission should succeed")
+	} else if state != StateNearLimit {
+		t.Errorf("state should be StateNearLimit once remaining permits drop below the soft limit, got: %v", state)
+	}
+}
+
+func TestAcquirePermissionRejectedState(t *testing.T) {
+	setup()
+
+	policy := Policy{
+		LimitRefreshPeriod: time.Millisecond * 10,
+		TimeoutDuration:    0,
+		LimitForPeriod:     1,
+	}
+	limiter := New(&policy)
+
+	if permitted, _, state := limiter.AcquirePermission(); !permitted || state != StateOK {
+		t.Errorf("first AcquirePermission should succeed with StateOK, got permitted=%v state=%v", permitted, state)
+	}
+
+	if permitted, _, state := limiter.AcquirePermission(); permitted || state != StateRejected {
+		t.Errorf("second AcquirePermission should be rejected, got permitted=%v state=%v", permitted, state)
+	}
+}
@@ -105,7 +105,7 @@ func TestRateLimiter(t *testing.T) {
 
 	limiter := New(&policy)
 	for i := 0; i < 30; i++ {
-		permitted, d := limiter.AcquirePermission()
+		permitted, d, _ := limiter.AcquirePermission()
 		if !permitted {
 			t.Errorf("AcquirePermission should succeed: %d", i)
 		}
@@ -114,14 +114,14 @@ func TestRateLimiter(t *testing.T) {
 		}
 	}
 
-	if permitted, d := limiter.AcquirePermission(); permitted {
+	if permitted, d, _ := limiter.AcquirePermission(); permitted {
 		t.Errorf("AcquirePermission should fail")
 	} else if d != policy.TimeoutDuration {
 		t.Errorf("wait duration should not be: %s", d.String())
 	}
 
 	now = now.Add(time.Millisecond * 5)
-	if permitted, d := limiter.AcquirePermission(); permitted {
+	if permitted, d, _ := limiter.AcquirePermission(); permitted {
 		t.Errorf("AcquirePermission should fail")
 	} else if d != policy.TimeoutDuration {
 		t.Errorf("wait duration should not be: %s", d.String())
@@ -129,14 +129,14 @@ func TestRateLimiter(t *testing.T) {
 
 	now = now.Add(time.Millisecond * 6)
 	for i := 0; i < 5; i++ {
-		if permitted, d := limiter.AcquirePermission(); !permitted {
+		if permitted, d, _ := limiter.AcquirePermission(); !permitted {
 			t.Errorf("AcquirePermission should succeed: %d", i)
 		} else if d != policy.TimeoutDuration-time.Millisecond {
 			t.Errorf("wait duration of %d should not be: %s", i, d.String())
 		}
 	}
 
-	if permitted, d := limiter.AcquirePermission(); permitted {
+	if permitted, d, _ := limiter.AcquirePermission(); permitted {
 		t.Errorf("AcquirePermission should fail")
 	} else if d != policy.TimeoutDuration {
 		t.Errorf("wait duration should not be: %s", d.String())
@@ -144,14 +144,14 @@ func TestRateLimiter(t *testing.T) {
 
 	now = now.Add(time.Millisecond * 89)
 	for i := 0; i < 30; i++ {
-		if permitted, d := limiter.AcquirePermission(); !permitted {
+		if permitted, d, _ := limiter.AcquirePermission(); !permitted {
 			t.Errorf("AcquirePermission should succeed: %d", i)
 		} else if d != time.Duration(i/policy.LimitForPeriod)*policy.LimitRefreshPeriod {
 			t.Errorf("wait duration of %d should not be: %s", i, d.String())
 		}
 	}
 
-	if permitted, d := limiter.AcquirePermission(); permitted {
+	if permitted, d, _ := limiter.AcquirePermission(); permitted {
 		t.Errorf("AcquirePermission should fail")
 	} else if d != policy.TimeoutDuration {
 		t.Errorf("wait duration should not be: %s", d.String())
@@ -0,0 +1,130 @@
+package plugins
+
+import (
+	"fmt"
+	"math"
+	"strings"
+	"time"
+
+	"github.com/hexdecteam/easegateway-types/pipelines"
+	"github.com/hexdecteam/easegateway-types/plugins"
+	"github.com/hexdecteam/easegateway-types/task"
+
+	"common"
+
+	"util/ratelimiter"
+)
+
+type bandwidthLimiterConfig struct {
+	common.PluginCommonConfig
+	BytesPerSecond uint64 `json:"bytes_per_second"`
+	BurstBytes     uint64 `json:"burst_bytes"`
+	TimeoutMSec    uint32 `json:"timeout_msec"`
+	SizeKey        string `json:"size_key"` // task value holding the request/response body length
+}
+
+func bandwidthLimiterConfigConstructor() plugins.Config {
+	return &bandwidthLimiterConfig{
+		TimeoutMSec: 1000,
+	}
+}
+
+func (c *bandwidthLimiterConfig) Prepare(pipelineNames []string) error {
+	err := c.PluginCommonConfig.Prepare(pipelineNames)
+	if err != nil {
+		return err
+	}
+
+	if c.BytesPerSecond < 1 {
+		return fmt.Errorf("invalid bytes per second")
+	}
+	if c.BytesPerSecond > math.MaxInt {
+		return fmt.Errorf("invalid bytes per second, must be <= %d", math.MaxInt)
+	}
+
+	if c.BurstBytes < c.BytesPerSecond {
+		return fmt.Errorf("invalid burst bytes, must be >= bytes per second")
+	}
+	if c.BurstBytes > math.MaxInt {
+		return fmt.Errorf("invalid burst bytes, must be <= %d", math.MaxInt)
+	}
+
+	c.SizeKey = strings.TrimSpace(c.SizeKey)
+	if len(c.SizeKey) == 0 {
+		return fmt.Errorf("invalid size key")
+	}
+
+	if c.TimeoutMSec < 1 {
+		return fmt.Errorf("invalid timeout millisecond")
+	}
+
+	return nil
+}
+
+////
+
+type bandwidthLimiter struct {
+	conf    *bandwidthLimiterConfig
+	limiter *ratelimiter.RateLimiter
+}
+
+func bandwidthLimiterConstructor(conf plugins.Config) (plugins.Plugin, plugins.PluginType, error) {
+	c, ok := conf.(*bandwidthLimiterConfig)
+	if !ok {
+		return nil, plugins.ProcessPlugin, fmt.Errorf("config type want *bandwidthLimiterConfig got %T", conf)
+	}
+
+	b := &bandwidthLimiter{
+		conf: c,
+		limiter: ratelimiter.New(&ratelimiter.Policy{
+			LimitRefreshPeriod: time.Second,
+			LimitForPeriod:     int(c.BytesPerSecond),
+			Burst:              int(c.BurstBytes),
+			TimeoutDuration:    time.Duration(c.TimeoutMSec) * time.Millisecond,
+		}),
+	}
+
+	return b, plugins.ProcessPlugin, nil
+}
+
+func (b *bandwidthLimiter) Prepare(ctx pipelines.PipelineContext) {
+	// Nothing to do.
+}
+
+func (b *bandwidthLimiter) Run(ctx pipelines.PipelineContext, t task.Task) error {
+	size, ok := t.Value(b.conf.SizeKey).(uint64)
+	if !ok || size == 0 {
+		return nil // nothing to meter, let it through
+	}
+
+	permitted, wait, _ := b.limiter.AcquirePermissionN(size)
+	if !permitted {
+		t.SetError(fmt.Errorf("service is unavailable caused by bandwidth limit"),
+			task.ResultFlowControl)
+		return nil
+	}
+
+	if wait > 0 {
+		select {
+		case <-time.After(wait):
+		case <-t.Cancel():
+			err := fmt.Errorf("task is cancelled by %s", t.CancelCause())
+			t.SetError(err, task.ResultTaskCancelled)
+			return t.Error()
+		}
+	}
+
+	return nil
+}
+
+func (b *bandwidthLimiter) Name() string {
+	return b.conf.PluginName()
+}
+
+func (b *bandwidthLimiter) CleanUp(ctx pipelines.PipelineContext) {
+	// Nothing to do.
+}
+
+func (b *bandwidthLimiter) Close() {
+	// Nothing to do.
+}
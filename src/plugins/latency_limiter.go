@@ -2,8 +2,10 @@ package plugins
 
 import (
 	"fmt"
+	"math"
 	"math/rand"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/hexdecteam/easegateway-types/pipelines"
@@ -14,14 +16,31 @@ import (
 	"logger"
 )
 
+// QuotaOverride customizes the latency limiter thresholds for a single
+// quota key, falling back to latencyLimiterConfig's own fields when a
+// value is left zero.
+type QuotaOverride struct {
+	LatencyThresholdMSec uint32 `json:"latency_threshold_msec"`
+	AllowMSec            uint16 `json:"allow_msec"`
+}
+
 type latencyLimiterConfig struct {
 	common.PluginCommonConfig
-	AllowMSec                uint16   `json:"allow_msec"`           // up to 65535
-	BackOffTimeoutMSec       int16    `json:"backoff_timeout_msec"` // zero means no queuing, -1 means no timeout
-	FlowControlPercentageKey string   `json:"flow_control_percentage_key"`
-	LatencyThresholdMSec     uint32   `json:"latency_threshold_msec"` // up to 4294967295
-	PluginsConcerned         []string `json:"plugins_concerned"`
-	ProbePercentage          uint8    `json:"probe_percentage"` // [1~99]
+	AllowMSec                uint16                   `json:"allow_msec"`           // up to 65535
+	BackOffTimeoutMSec       int16                    `json:"backoff_timeout_msec"` // zero means no queuing, -1 means no timeout
+	FlowControlPercentageKey string                   `json:"flow_control_percentage_key"`
+	LatencyThresholdMSec     uint32                   `json:"latency_threshold_msec"` // up to 4294967295
+	PluginsConcerned         []string                 `json:"plugins_concerned"`
+	ProbePercentage          uint8                    `json:"probe_percentage"` // [1~99]
+	QuotaKey                 string                   `json:"quota_key"`        // path into task values, e.g. client IP, tenant header, API key
+	QuotaOverrides           map[string]QuotaOverride `json:"quota_overrides"`  // keyed by the value QuotaKey resolves to
+	PurgeIntervalSec         uint32                   `json:"purge_interval_sec"`
+	PurgeTTLSec              uint32                   `json:"purge_ttl_sec"`
+	BackOffInitialMSec       uint32                   `json:"backoff_initial_msec"` // first wait of the backoff poll loop
+	BackOffMaxMSec           uint32                   `json:"backoff_max_msec"`     // cap of the backoff poll loop
+	BackOffJitter            float64                  `json:"backoff_jitter"`       // [0, 1), randomizes each wait by +/- jitter/2
+	SoftLimitRatio           float64                  `json:"soft_limit_ratio"`     // (0, 1], zero disables the near-limit warning
+	WarnKey                  string                   `json:"warn_key"`             // task value set to a warning when the soft limit is crossed
 }
 
 func latencyLimiterConfigConstructor() plugins.Config {
@@ -30,6 +49,13 @@ func latencyLimiterConfigConstructor() plugins.Config {
 		BackOffTimeoutMSec:   1000,
 		AllowMSec:            1000,
 		ProbePercentage:      10,
+		PurgeIntervalSec:     60,
+		PurgeTTLSec:          600,
+		BackOffInitialMSec:   10,
+		BackOffMaxMSec:       500,
+		BackOffJitter:        0.2,
+		SoftLimitRatio:       0.8,
+		WarnKey:              "x-flow-control-warning",
 	}
 }
 
@@ -69,6 +95,32 @@ func (c *latencyLimiterConfig) Prepare(pipelineNames []string) error {
 		return fmt.Errorf("invalid probe percentage (requires bigger than zero and less than 100)")
 	}
 	c.FlowControlPercentageKey = strings.TrimSpace(c.FlowControlPercentageKey)
+	c.QuotaKey = strings.TrimSpace(c.QuotaKey)
+
+	if c.PurgeIntervalSec < 1 {
+		return fmt.Errorf("invalid purge interval")
+	}
+
+	if c.PurgeTTLSec < 1 {
+		return fmt.Errorf("invalid purge ttl")
+	}
+
+	if c.BackOffInitialMSec < 1 {
+		return fmt.Errorf("invalid backoff initial millisecond")
+	}
+
+	if c.BackOffMaxMSec < c.BackOffInitialMSec {
+		return fmt.Errorf("invalid backoff max millisecond, must be >= backoff initial millisecond")
+	}
+
+	if c.BackOffJitter < 0 || c.BackOffJitter >= 1 {
+		return fmt.Errorf("invalid backoff jitter, must be within [0, 1)")
+	}
+
+	if c.SoftLimitRatio < 0 || c.SoftLimitRatio > 1 {
+		return fmt.Errorf("invalid soft limit ratio, must be within [0, 1]")
+	}
+	c.WarnKey = strings.TrimSpace(c.WarnKey)
 
 	return nil
 }
@@ -76,7 +128,9 @@ func (c *latencyLimiterConfig) Prepare(pipelineNames []string) error {
 ////
 
 type latencyWindowLimiter struct {
-	conf *latencyLimiterConfig
+	conf  *latencyLimiterConfig
+	quota *quotaManager // nil unless conf.QuotaKey is set, see quotaKeyOf
+	warn  *warnThrottle // nil unless conf.SoftLimitRatio is set
 }
 
 func latencyLimiterConstructor(conf plugins.Config) (plugins.Plugin, plugins.PluginType, error) {
@@ -95,6 +149,77 @@ func latencyLimiterConstructor(conf plugins.Config) (plugins.Plugin, plugins.Plu
 func (l *latencyWindowLimiter) Prepare(ctx pipelines.PipelineContext) {
 	// Register as plugin level indicator, so we don't need to unregister them in CleanUp()
 	registerPluginIndicatorForLimiter(ctx, l.Name(), pipelines.STATISTICS_INDICATOR_FOR_ALL_PLUGIN_INSTANCE)
+
+	if len(l.conf.QuotaKey) != 0 && l.quota == nil {
+		l.quota = newQuotaManager(ctx, l.Name(), l.conf, l.allowMSecFor)
+	}
+
+	if l.conf.SoftLimitRatio > 0 && l.warn == nil {
+		l.warn = newWarnThrottle(5 * time.Minute)
+	}
+}
+
+// quotaKeyOf resolves the quota key of t, the empty string when quoting is
+// disabled or the task carries no value for conf.QuotaKey.
+func (l *latencyWindowLimiter) quotaKeyOf(t task.Task) string {
+	if len(l.conf.QuotaKey) == 0 {
+		return ""
+	}
+
+	if v, ok := t.Value(l.conf.QuotaKey).(string); ok {
+		return v
+	}
+
+	return ""
+}
+
+func (l *latencyWindowLimiter) allowMSecFor(key string) uint16 {
+	if o, ok := l.conf.QuotaOverrides[key]; ok && o.AllowMSec > 0 {
+		return o.AllowMSec
+	}
+	return l.conf.AllowMSec
+}
+
+func (l *latencyWindowLimiter) latencyThresholdMSecFor(key string) uint32 {
+	if o, ok := l.conf.QuotaOverrides[key]; ok && o.LatencyThresholdMSec > 0 {
+		return o.LatencyThresholdMSec
+	}
+	return l.conf.LatencyThresholdMSec
+}
+
+// counterProvider returns a function yielding the latencyLimiterCounter
+// that should observe the current request: the single pipeline-wide
+// counter when quoting is disabled, or key's own counter in l.quota
+// otherwise.
+func (l *latencyWindowLimiter) counterProvider(ctx pipelines.PipelineContext, key string) func() (*latencyLimiterCounter, error) {
+	if l.quota == nil {
+		return func() (*latencyLimiterCounter, error) {
+			return getLatencyLimiterCounter(ctx, l.Name(), l.conf.AllowMSec)
+		}
+	}
+
+	return func() (*latencyLimiterCounter, error) {
+		return l.quota.get(key), nil
+	}
+}
+
+// backOffWait returns the wait before the next backoff poll, similar to
+// Kubernetes' flowcontrol.Backoff: it doubles BackOffInitialMSec every
+// attempt, caps at BackOffMaxMSec and randomizes the result by up to
+// +/- BackOffJitter/2 to avoid a thundering herd of requests waking on
+// the same tick.
+func (l *latencyWindowLimiter) backOffWait(attempt int) time.Duration {
+	backOffMSec := float64(l.conf.BackOffMaxMSec)
+	if attempt < 32 { // avoid overflowing math.Pow for pathologically long backoffs
+		if doubled := float64(l.conf.BackOffInitialMSec) * math.Pow(2, float64(attempt)); doubled < backOffMSec {
+			backOffMSec = doubled
+		}
+	}
+
+	jitter := l.conf.BackOffJitter
+	backOffMSec *= 1 + rand.Float64()*jitter - jitter/2
+
+	return time.Duration(backOffMSec * float64(time.Millisecond))
 }
 
 // Probe: don't totally fuse outbound requests because we need small amount of requests to probe the concerned target
@@ -108,12 +233,16 @@ func (l *latencyWindowLimiter) isProbe(outboundRate float64, inboundRate float64
 }
 
 func (l *latencyWindowLimiter) Run(ctx pipelines.PipelineContext, t task.Task) error {
+	key := l.quotaKeyOf(t)
+	allowMSec := l.allowMSecFor(key)
+	counterProvider := l.counterProvider(ctx, key)
+
 	t.AddFinishedCallback(fmt.Sprintf("%s-checkLatency", l.Name()),
-		getTaskFinishedCallbackInLatencyLimiter(ctx, l.conf.PluginsConcerned, l.conf.LatencyThresholdMSec, l.conf.AllowMSec, l.Name()))
+		getTaskFinishedCallbackInLatencyLimiter(ctx, counterProvider, l.conf.PluginsConcerned, l.latencyThresholdMSecFor(key), l.Name()))
 
 	go updateInboundThroughputRate(ctx, l.Name()) // ignore error if it occurs
 
-	counter, err := getLatencyLimiterCounter(ctx, l.Name(), l.conf.AllowMSec)
+	counter, err := counterProvider()
 	if err != nil {
 		return nil
 	}
@@ -132,10 +261,22 @@ func (l *latencyWindowLimiter) Run(ctx pipelines.PipelineContext, t task.Task) e
 	}
 
 	inboundRate, _ := r.Get()                                                                    // ignore error safely
-	// use l.conf.AllowMSec to avoid thrashing caused by network, upstream server gc or other factors
-	counterThreshold := uint64(float64(l.conf.AllowMSec) / 1000.0 * outboundRate)
+	// use allowMSec to avoid thrashing caused by network, upstream server gc or other factors
+	counterThreshold := uint64(float64(allowMSec) / 1000.0 * outboundRate)
 	count := counter.Count()
 	logger.Debugf("[inboundRate: %.3f, outboundRate: %.3f, counter: %d, counterThreshold: %d]", inboundRate, outboundRate, counter.Count(), counterThreshold)
+
+	if l.conf.SoftLimitRatio > 0 && count <= counterThreshold &&
+		float64(count) > float64(counterThreshold)*l.conf.SoftLimitRatio { // near, but not yet over, the hard limit
+		if len(l.conf.WarnKey) != 0 {
+			t.WithValue(l.conf.WarnKey, "latency-degraded")
+		}
+		if l.warn != nil {
+			l.warn.tryWarn("[pipeline %s approaching latency limit: counter %d, threshold %d]",
+				ctx.PipelineName(), count, counterThreshold)
+		}
+	}
+
 	if count > counterThreshold { // needs flow control
 		go updateFlowControlledThroughputRate(ctx, l.Name())
 
@@ -151,21 +292,21 @@ func (l *latencyWindowLimiter) Run(ctx pipelines.PipelineContext, t task.Task) e
 				backOffTimeout = time.After(time.Duration(l.conf.BackOffTimeoutMSec) * time.Millisecond)
 			}
 
-			backOffStep := 10
-			if int(l.conf.BackOffTimeoutMSec) <= backOffStep {
-				backOffStep = 1
-			} else {
-				backOffStep = int(l.conf.BackOffTimeoutMSec / 10)
-			}
-			// wait until timeout, cancel or latency recoveryed
+			// wait until timeout, cancel or latency recoveryed, polling with
+			// capped exponential backoff + jitter so many queued requests
+			// woken on the same tick don't all re-check at once
+			backOffAttempt := 0
 		LOOP:
 			for {
+				wait := l.backOffWait(backOffAttempt)
+				backOffAttempt++
+
 				select {
 				case <-backOffTimeout: // receive on a nil channel will always block
 					t.SetError(fmt.Errorf("service is unavailable caused by latency limit backoff timeout"),
 						task.ResultFlowControl)
 					return nil
-				case <-time.After(time.Duration(backOffStep) * time.Millisecond):
+				case <-time.After(wait):
 					if counter.Count() < counterThreshold {
 						logger.Debugf("[successfully passed latency limiter after backed off]")
 						break LOOP
@@ -201,7 +342,12 @@ func (h *latencyWindowLimiter) CleanUp(ctx pipelines.PipelineContext) {
 }
 
 func (l *latencyWindowLimiter) Close() {
-	// Nothing to do.
+	if l.quota != nil {
+		l.quota.Close()
+	}
+	if l.warn != nil {
+		l.warn.Close()
+	}
 }
 
 ////
@@ -215,10 +361,17 @@ const (
 // below.
 //
 // The maximum counter will be math.max(1, maxCountMSec/1000.0 * outBoundThroughputRate1)
+//
+// mutex guards closed and the send to c: Close() can run concurrently with
+// Increase()/Decrease() once a quotaManager purges a counter out from under
+// a request that's still holding a reference to it, and without it a send
+// can race a concurrent close(c) and panic.
 type latencyLimiterCounter struct {
 	c       chan *bool
 	counter uint64
-	closed  bool
+
+	mutex  sync.Mutex
+	closed bool
 }
 
 func newLatencyLimiterCounter(ctx pipelines.PipelineContext, pluginName string, maxCountMSec uint16) *latencyLimiterCounter {
@@ -255,6 +408,8 @@ func newLatencyLimiterCounter(ctx pipelines.PipelineContext, pluginName string,
 }
 
 func (c *latencyLimiterCounter) Increase() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
 	if !c.closed {
 		f := true
 		c.c <- &f
@@ -262,6 +417,8 @@ func (c *latencyLimiterCounter) Increase() {
 }
 
 func (c *latencyLimiterCounter) Decrease() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
 	if !c.closed {
 		f := false
 		c.c <- &f
@@ -269,7 +426,10 @@ func (c *latencyLimiterCounter) Decrease() {
 }
 
 func (c *latencyLimiterCounter) Count() uint64 {
-	if c.closed {
+	c.mutex.Lock()
+	closed := c.closed
+	c.mutex.Unlock()
+	if closed {
 		return 0
 	}
 
@@ -281,6 +441,11 @@ func (c *latencyLimiterCounter) Count() uint64 {
 }
 
 func (c *latencyLimiterCounter) Close() error { // io.Closer stub
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.closed {
+		return nil
+	}
 	c.closed = true
 	close(c.c)
 	return nil
@@ -301,8 +466,8 @@ func getLatencyLimiterCounter(ctx pipelines.PipelineContext, pluginName string,
 	return counter.(*latencyLimiterCounter), nil
 }
 
-func getTaskFinishedCallbackInLatencyLimiter(ctx pipelines.PipelineContext, pluginsConcerned []string,
-	latencyThresholdMSec uint32, allowMSec uint16, pluginName string) task.TaskFinished {
+func getTaskFinishedCallbackInLatencyLimiter(ctx pipelines.PipelineContext, counterProvider func() (*latencyLimiterCounter, error),
+	pluginsConcerned []string, latencyThresholdMSec uint32, pluginName string) task.TaskFinished {
 
 	return func(t1 task.Task, _ task.TaskStatus) {
 		var latency float64
@@ -333,7 +498,7 @@ func getTaskFinishedCallbackInLatencyLimiter(ctx pipelines.PipelineContext, plug
 			return
 		}
 
-		counter, err := getLatencyLimiterCounter(ctx, pluginName, allowMSec)
+		counter, err := counterProvider()
 		if err != nil { // ignore error safely
 			return
 		}
@@ -0,0 +1,57 @@
+package plugins
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBackOffWaitDoublesUntilCap(t *testing.T) {
+	l := &latencyWindowLimiter{
+		conf: &latencyLimiterConfig{
+			BackOffInitialMSec: 10,
+			BackOffMaxMSec:     80,
+			BackOffJitter:      0, // disable jitter so the progression is exact
+		},
+	}
+
+	expectedMSec := []int64{10, 20, 40, 80, 80, 80} // caps at BackOffMaxMSec
+	for attempt, wantMSec := range expectedMSec {
+		got := l.backOffWait(attempt)
+		want := time.Duration(wantMSec) * time.Millisecond
+		if got != want {
+			t.Errorf("backOffWait(%d) = %s, want %s", attempt, got, want)
+		}
+	}
+}
+
+func TestBackOffWaitAppliesJitter(t *testing.T) {
+	l := &latencyWindowLimiter{
+		conf: &latencyLimiterConfig{
+			BackOffInitialMSec: 100,
+			BackOffMaxMSec:     100,
+			BackOffJitter:      0.2, // +/- 10%
+		},
+	}
+
+	lower := time.Duration(90) * time.Millisecond
+	upper := time.Duration(110) * time.Millisecond
+	for i := 0; i < 50; i++ {
+		if got := l.backOffWait(0); got < lower || got > upper {
+			t.Errorf("backOffWait with jitter 0.2 = %s, want within [%s, %s]", got, lower, upper)
+		}
+	}
+}
+
+func TestBackOffWaitDoesNotOverflowForLargeAttempts(t *testing.T) {
+	l := &latencyWindowLimiter{
+		conf: &latencyLimiterConfig{
+			BackOffInitialMSec: 10,
+			BackOffMaxMSec:     500,
+			BackOffJitter:      0,
+		},
+	}
+
+	if got := l.backOffWait(1000); got != time.Duration(500)*time.Millisecond {
+		t.Errorf("backOffWait(1000) = %s, want the capped 500ms", got)
+	}
+}
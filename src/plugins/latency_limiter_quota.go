@@ -0,0 +1,130 @@
+package plugins
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/hexdecteam/easegateway-types/pipelines"
+)
+
+// quotaManager keys latencyLimiterCounter state by a per-request attribute
+// (client IP, tenant header, API key, ...) so a single latencyWindowLimiter
+// instance can protect many clients independently instead of sharing one
+// global counter. Idle keys are purged on a timer so memory stays bounded
+// no matter how many distinct clients have ever been seen.
+type quotaManager struct {
+	ctx          pipelines.PipelineContext
+	pluginName   string
+	allowMSecFor func(key string) uint16 // shares latencyWindowLimiter's QuotaOverrides resolution
+
+	mutex   sync.RWMutex
+	buckets map[string]*quotaBucket
+
+	purgeTTL  time.Duration
+	closeCh   chan struct{}
+	closeOnce sync.Once
+}
+
+// quotaBucket pairs a latencyLimiterCounter with the last time it was
+// touched, so the purge loop can tell idle keys from active ones.
+type quotaBucket struct {
+	counter      *latencyLimiterCounter
+	lastActiveAt int64 // unix nano, updated with atomic
+}
+
+func (b *quotaBucket) touch() {
+	atomic.StoreInt64(&b.lastActiveAt, time.Now().UnixNano())
+}
+
+func newQuotaManager(ctx pipelines.PipelineContext, pluginName string, conf *latencyLimiterConfig, allowMSecFor func(key string) uint16) *quotaManager {
+	m := &quotaManager{
+		ctx:          ctx,
+		pluginName:   pluginName,
+		allowMSecFor: allowMSecFor,
+		buckets:      make(map[string]*quotaBucket),
+		purgeTTL:     time.Duration(conf.PurgeTTLSec) * time.Second,
+		closeCh:      make(chan struct{}),
+	}
+
+	go m.purgeLoop(time.Duration(conf.PurgeIntervalSec) * time.Second)
+
+	return m
+}
+
+// get returns the latencyLimiterCounter for key, creating one on first use.
+func (m *quotaManager) get(key string) *latencyLimiterCounter {
+	m.mutex.RLock()
+	bucket, ok := m.buckets[key]
+	// touch while still holding the lock: purge() needs the write lock to
+	// close and evict a bucket, so it can't race between our read and our
+	// touch here and hand back an already-closed counter.
+	if ok {
+		bucket.touch()
+	}
+	m.mutex.RUnlock()
+	if ok {
+		return bucket.counter
+	}
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if bucket, ok = m.buckets[key]; ok { // someone else created it while we waited for the lock
+		bucket.touch()
+		return bucket.counter
+	}
+
+	bucket = &quotaBucket{
+		counter: newLatencyLimiterCounter(m.ctx, m.pluginName, 2*m.allowMSecFor(key)),
+	}
+	bucket.touch()
+	m.buckets[key] = bucket
+
+	return bucket.counter
+}
+
+func (m *quotaManager) purgeLoop(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			m.purge()
+		case <-m.closeCh:
+			return
+		}
+	}
+}
+
+func (m *quotaManager) purge() {
+	deadline := time.Now().Add(-m.purgeTTL)
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	for key, bucket := range m.buckets {
+		lastActiveAt := time.Unix(0, atomic.LoadInt64(&bucket.lastActiveAt))
+		if lastActiveAt.Before(deadline) {
+			bucket.counter.Close()
+			delete(m.buckets, key)
+		}
+	}
+}
+
+// Close stops the purge loop and closes every remaining per-key counter,
+// it must be called when the owning plugin instance is torn down.
+func (m *quotaManager) Close() {
+	m.closeOnce.Do(func() {
+		close(m.closeCh)
+	})
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	for key, bucket := range m.buckets {
+		bucket.counter.Close()
+		delete(m.buckets, key)
+	}
+}
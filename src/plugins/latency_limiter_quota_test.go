@@ -0,0 +1,100 @@
+package plugins
+
+import (
+	"runtime"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestQuotaManagerPurgeEvictsOnlyIdleBuckets(t *testing.T) {
+	conf := &latencyLimiterConfig{
+		AllowMSec:        1000,
+		PurgeIntervalSec: 3600, // keep the background loop from interfering, purge() is called directly below
+		PurgeTTLSec:      1,
+	}
+
+	m := newQuotaManager(nil, "test-plugin", conf, (&latencyWindowLimiter{conf: conf}).allowMSecFor)
+	defer m.Close()
+
+	m.get("idle")
+	m.get("active")
+
+	// simulate the idle bucket having gone untouched past the TTL
+	idleBucket := m.buckets["idle"]
+	atomic.StoreInt64(&idleBucket.lastActiveAt, time.Now().Add(-2*time.Second).UnixNano())
+
+	m.purge()
+
+	if _, ok := m.buckets["idle"]; ok {
+		t.Errorf("idle bucket should have been purged")
+	}
+	if !idleBucket.counter.closed {
+		t.Errorf("purged bucket's counter should be closed")
+	}
+
+	activeBucket, ok := m.buckets["active"]
+	if !ok {
+		t.Fatalf("active bucket should not have been purged")
+	}
+	if activeBucket.counter.closed {
+		t.Errorf("active bucket's counter should remain open")
+	}
+}
+
+func TestQuotaManagerGetTouchesExistingBucket(t *testing.T) {
+	conf := &latencyLimiterConfig{
+		AllowMSec:        1000,
+		PurgeIntervalSec: 3600,
+		PurgeTTLSec:      1,
+	}
+
+	m := newQuotaManager(nil, "test-plugin", conf, (&latencyWindowLimiter{conf: conf}).allowMSecFor)
+	defer m.Close()
+
+	m.get("client")
+	bucket := m.buckets["client"]
+	atomic.StoreInt64(&bucket.lastActiveAt, time.Now().Add(-2*time.Second).UnixNano())
+
+	m.get("client") // should touch, not recreate
+
+	if bucket != m.buckets["client"] {
+		t.Fatalf("get should reuse the existing bucket")
+	}
+	if time.Unix(0, atomic.LoadInt64(&bucket.lastActiveAt)).Before(time.Now().Add(-time.Second)) {
+		t.Errorf("get should have refreshed lastActiveAt")
+	}
+}
+
+func TestQuotaManagerCloseEvictsBucketsAndStopsPurgeLoop(t *testing.T) {
+	conf := &latencyLimiterConfig{
+		AllowMSec:        1000,
+		PurgeIntervalSec: 1,
+		PurgeTTLSec:      1,
+	}
+
+	before := runtime.NumGoroutine()
+
+	m := newQuotaManager(nil, "test-plugin", conf, (&latencyWindowLimiter{conf: conf}).allowMSecFor)
+	m.get("client-a")
+	m.get("client-b")
+
+	// purgeLoop plus one latencyLimiterCounter goroutine per bucket.
+	if got := runtime.NumGoroutine(); got < before+3 {
+		t.Fatalf("expected at least 3 new goroutines, have %d (started from %d)", got, before)
+	}
+
+	m.Close()
+
+	if len(m.buckets) != 0 {
+		t.Errorf("Close should evict every remaining bucket, got %d left", len(m.buckets))
+	}
+
+	deadline := time.Now().Add(time.Second)
+	for runtime.NumGoroutine() > before {
+		if time.Now().After(deadline) {
+			t.Fatalf("goroutines leaked after Close(): have %d, started from %d", runtime.NumGoroutine(), before)
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+}
@@ -0,0 +1,56 @@
+package plugins
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"logger"
+)
+
+// warnThrottle gates logger.Warnf calls to at most once per interval, so a
+// hot path crossing a soft limit on every request doesn't spam the log.
+type warnThrottle struct {
+	ready     int32 // atomic, 1 = a call to tryWarn may log now
+	closeCh   chan struct{}
+	closeOnce sync.Once
+}
+
+func newWarnThrottle(interval time.Duration) *warnThrottle {
+	w := &warnThrottle{
+		ready:   1, // allow the first warning immediately
+		closeCh: make(chan struct{}),
+	}
+
+	go w.loop(interval)
+
+	return w
+}
+
+func (w *warnThrottle) loop(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			atomic.StoreInt32(&w.ready, 1)
+		case <-w.closeCh:
+			return
+		}
+	}
+}
+
+// tryWarn logs format/args via logger.Warnf only if no other call has
+// logged since the last tick of the throttle's interval.
+func (w *warnThrottle) tryWarn(format string, args ...interface{}) {
+	if atomic.CompareAndSwapInt32(&w.ready, 1, 0) {
+		logger.Warnf(format, args...)
+	}
+}
+
+func (w *warnThrottle) Close() {
+	w.closeOnce.Do(func() {
+		close(w.closeCh)
+	})
+}
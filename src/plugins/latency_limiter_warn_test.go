@@ -0,0 +1,58 @@
+package plugins
+
+import (
+	"runtime"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestWarnThrottleRateLimits(t *testing.T) {
+	w := newWarnThrottle(time.Hour) // ticker far in the future, only the initial ready=1 is exercised here
+	defer w.Close()
+
+	if atomic.LoadInt32(&w.ready) != 1 {
+		t.Fatalf("warnThrottle should allow the first warning immediately")
+	}
+
+	w.tryWarn("first")
+	if atomic.LoadInt32(&w.ready) != 0 {
+		t.Errorf("tryWarn should consume the ready flag")
+	}
+
+	w.tryWarn("second, should be suppressed")
+	if atomic.LoadInt32(&w.ready) != 0 {
+		t.Errorf("ready flag should still be consumed, tryWarn must not log twice within the interval")
+	}
+}
+
+func TestWarnThrottleResetsOnTick(t *testing.T) {
+	w := newWarnThrottle(time.Millisecond * 10)
+	defer w.Close()
+
+	w.tryWarn("first")
+
+	time.Sleep(time.Millisecond * 50) // let the ticker fire at least once
+
+	if atomic.LoadInt32(&w.ready) != 1 {
+		t.Errorf("ready flag should be restored once the throttle interval elapses")
+	}
+}
+
+func TestWarnThrottleCloseStopsLoop(t *testing.T) {
+	w := newWarnThrottle(time.Millisecond * 10)
+
+	time.Sleep(time.Millisecond) // let loop's goroutine actually start
+	running := runtime.NumGoroutine()
+
+	w.Close()
+	w.Close() // must be safe to call twice
+
+	deadline := time.Now().Add(time.Second)
+	for runtime.NumGoroutine() >= running {
+		if time.Now().After(deadline) {
+			t.Fatalf("warnThrottle.loop leaked after Close()")
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+}